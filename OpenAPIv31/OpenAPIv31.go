@@ -0,0 +1,444 @@
+// Copyright 2026 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package openapi_v31 compiles OpenAPI 3.1 descriptions read from JSON/YAML
+// into the Document model below, mirroring OpenAPIv3's NewDocument but
+// accounting for the 3.1 line's alignment with JSON Schema 2020-12: a
+// schema's "type" may be a string or an array of strings, "nullable" no
+// longer exists and is translated into a "null" type-array entry, and
+// documents may carry top-level "webhooks" and "jsonSchemaDialect" fields.
+//
+// Document is a plain Go struct, not a generated protobuf message: it has
+// no field tags for proto's reflection-based encoder to use, so callers
+// must not pass it to proto.Marshal or otherwise treat it as wire-compatible
+// with OpenAPIv2/OpenAPIv3.Document. It satisfies the legacy proto.Message
+// interface only so it can be passed around gnostic's existing
+// proto.Message-typed plumbing.
+//
+// Explicit descope: reading a 3.1 description and resolving its internal
+// "#/components/schemas/..." references is supported. Writing a compiled
+// 3.1 document back out (--pb-out, --json-out, --text-out) and handing
+// one to a plugin are not yet supported and are rejected with an error by
+// gnostic.go rather than attempted, both because Document isn't a real
+// protobuf message and because path items and webhooks are compiled as
+// raw, uninterpreted values (see PathItem) rather than a structure any of
+// those outputs could render correctly.
+package openapi_v31
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/googleapis/gnostic/compiler"
+)
+
+// Document is the root of a compiled OpenAPI 3.1 description.
+type Document struct {
+	Openapi           string
+	Info              *Info
+	JsonSchemaDialect string
+	Servers           []*Server
+	Paths             *Paths
+	Webhooks          []*NamedPathItem
+	Components        *Components
+	Security          []*SecurityRequirement
+	Tags              []*Tag
+	ExternalDocs      *ExternalDocs
+}
+
+// Info mirrors OpenAPIv3's Info object.
+type Info struct {
+	Title          string
+	Summary        string
+	Description    string
+	TermsOfService string
+	Version        string
+}
+
+// Server mirrors OpenAPIv3's Server object.
+type Server struct {
+	Url         string
+	Description string
+}
+
+// Paths holds the compiled path item map, keyed by path template.
+type Paths struct {
+	Path []*NamedPathItem
+}
+
+// NamedPathItem pairs a path (or webhook) name with its compiled PathItem.
+type NamedPathItem struct {
+	Name  string
+	Value *PathItem
+}
+
+// PathItem is left uninterpreted beyond its raw operations; this package
+// focuses on the document and schema model changes introduced by 3.1.
+type PathItem struct {
+	Raw interface{}
+}
+
+// Components mirrors OpenAPIv3's Components object, with Schemas reworked
+// to the 3.1 SchemaOrReference model below.
+type Components struct {
+	Schemas map[string]*SchemaOrReference
+}
+
+// SecurityRequirement mirrors OpenAPIv3's SecurityRequirement object.
+type SecurityRequirement struct {
+	AdditionalProperties map[string][]string
+}
+
+// Tag mirrors OpenAPIv3's Tag object.
+type Tag struct {
+	Name        string
+	Description string
+}
+
+// ExternalDocs mirrors OpenAPIv3's ExternalDocs object.
+type ExternalDocs struct {
+	Description string
+	Url         string
+}
+
+// SchemaOrReference is either a Schema or a $ref, following the existing
+// OpenAPIv3 compiler convention.
+type SchemaOrReference struct {
+	Schema    *Schema
+	Reference *Reference
+}
+
+// Reference mirrors OpenAPIv3's Reference object.
+type Reference struct {
+	XRef string
+}
+
+// SchemaType holds a JSON Schema 2020-12 "type" keyword, which may be a
+// single type name or, as of 3.1, an array of type names (most commonly
+// used to express nullability as e.g. ["string", "null"]).
+type SchemaType struct {
+	TypeArray []string
+}
+
+// AsArray returns the type keyword normalized to an array, regardless of
+// whether it was written as a single string or an array in the source.
+func (t *SchemaType) AsArray() []string {
+	if t == nil {
+		return nil
+	}
+	return t.TypeArray
+}
+
+// Schema is a 3.1 JSON Schema node. Unlike OpenAPIv3.Schema, Type is a
+// SchemaType rather than a bare string, and there is no separate Nullable
+// field: a nullable 3.0 schema becomes a 3.1 schema whose Type array
+// includes "null".
+type Schema struct {
+	Type        *SchemaType
+	Format      string
+	Description string
+	Default     interface{}
+	Enum        []interface{}
+	Properties  map[string]*SchemaOrReference
+	Items       *SchemaOrReference
+}
+
+// NewDocument builds a Document from a parsed JSON/YAML info tree, the same
+// calling convention used by openapi_v2.NewDocument and openapi_v3.NewDocument.
+func NewDocument(info interface{}, context *compiler.Context) (*Document, error) {
+	m, ok := compiler.UnpackMap(info)
+	if !ok {
+		return nil, fmt.Errorf("openapi_v31: could not unpack document")
+	}
+
+	d := &Document{}
+	if v, ok := compiler.MapValueForKey(m, "openapi").(string); ok {
+		d.Openapi = v
+	}
+	if v, ok := compiler.MapValueForKey(m, "jsonSchemaDialect").(string); ok {
+		d.JsonSchemaDialect = v
+	}
+	if infoMap, ok := compiler.UnpackMap(compiler.MapValueForKey(m, "info")); ok {
+		d.Info = &Info{}
+		if v, ok := compiler.MapValueForKey(infoMap, "title").(string); ok {
+			d.Info.Title = v
+		}
+		if v, ok := compiler.MapValueForKey(infoMap, "summary").(string); ok {
+			d.Info.Summary = v
+		}
+		if v, ok := compiler.MapValueForKey(infoMap, "description").(string); ok {
+			d.Info.Description = v
+		}
+		if v, ok := compiler.MapValueForKey(infoMap, "version").(string); ok {
+			d.Info.Version = v
+		}
+	}
+	if componentsMap, ok := compiler.UnpackMap(compiler.MapValueForKey(m, "components")); ok {
+		d.Components = &Components{Schemas: map[string]*SchemaOrReference{}}
+		if schemasMap, ok := compiler.UnpackMap(compiler.MapValueForKey(componentsMap, "schemas")); ok {
+			for _, item := range schemasMap {
+				name, ok := item.Key.(string)
+				if !ok {
+					continue
+				}
+				schema, err := NewSchemaOrReference(item.Value, context)
+				if err != nil {
+					return nil, err
+				}
+				d.Components.Schemas[name] = schema
+			}
+		}
+	}
+	if serversSlice, ok := compiler.MapValueForKey(m, "servers").([]interface{}); ok {
+		for _, item := range serversSlice {
+			serverMap, ok := compiler.UnpackMap(item)
+			if !ok {
+				continue
+			}
+			server := &Server{}
+			if v, ok := compiler.MapValueForKey(serverMap, "url").(string); ok {
+				server.Url = v
+			}
+			if v, ok := compiler.MapValueForKey(serverMap, "description").(string); ok {
+				server.Description = v
+			}
+			d.Servers = append(d.Servers, server)
+		}
+	}
+	if pathsMap, ok := compiler.UnpackMap(compiler.MapValueForKey(m, "paths")); ok {
+		for _, item := range pathsMap {
+			name, ok := item.Key.(string)
+			if !ok {
+				continue
+			}
+			d.Paths = appendNamedPathItem(d.Paths, name, item.Value)
+		}
+	}
+	if webhooksMap, ok := compiler.UnpackMap(compiler.MapValueForKey(m, "webhooks")); ok {
+		for _, item := range webhooksMap {
+			name, ok := item.Key.(string)
+			if !ok {
+				continue
+			}
+			d.Webhooks = append(d.Webhooks, &NamedPathItem{Name: name, Value: &PathItem{Raw: item.Value}})
+		}
+	}
+	if securitySlice, ok := compiler.MapValueForKey(m, "security").([]interface{}); ok {
+		for _, item := range securitySlice {
+			requirementMap, ok := compiler.UnpackMap(item)
+			if !ok {
+				continue
+			}
+			requirement := &SecurityRequirement{AdditionalProperties: map[string][]string{}}
+			for _, entry := range requirementMap {
+				name, ok := entry.Key.(string)
+				if !ok {
+					continue
+				}
+				scopesSlice, ok := entry.Value.([]interface{})
+				if !ok {
+					continue
+				}
+				var scopes []string
+				for _, scope := range scopesSlice {
+					if s, ok := scope.(string); ok {
+						scopes = append(scopes, s)
+					}
+				}
+				requirement.AdditionalProperties[name] = scopes
+			}
+			d.Security = append(d.Security, requirement)
+		}
+	}
+	if tagsSlice, ok := compiler.MapValueForKey(m, "tags").([]interface{}); ok {
+		for _, item := range tagsSlice {
+			tagMap, ok := compiler.UnpackMap(item)
+			if !ok {
+				continue
+			}
+			tag := &Tag{}
+			if v, ok := compiler.MapValueForKey(tagMap, "name").(string); ok {
+				tag.Name = v
+			}
+			if v, ok := compiler.MapValueForKey(tagMap, "description").(string); ok {
+				tag.Description = v
+			}
+			d.Tags = append(d.Tags, tag)
+		}
+	}
+	if externalDocsMap, ok := compiler.UnpackMap(compiler.MapValueForKey(m, "externalDocs")); ok {
+		d.ExternalDocs = &ExternalDocs{}
+		if v, ok := compiler.MapValueForKey(externalDocsMap, "description").(string); ok {
+			d.ExternalDocs.Description = v
+		}
+		if v, ok := compiler.MapValueForKey(externalDocsMap, "url").(string); ok {
+			d.ExternalDocs.Url = v
+		}
+	}
+	return d, nil
+}
+
+// appendNamedPathItem adds a compiled path entry to paths, allocating paths
+// if this is the first one.
+func appendNamedPathItem(paths *Paths, name string, raw interface{}) *Paths {
+	if paths == nil {
+		paths = &Paths{}
+	}
+	paths.Path = append(paths.Path, &NamedPathItem{Name: name, Value: &PathItem{Raw: raw}})
+	return paths
+}
+
+// NewSchemaOrReference compiles a schema node, translating 3.0-style
+// "nullable: true" into a 3.1 type array and accepting "type" as either a
+// string or an array of strings. It recurses into "properties" and "items"
+// so nested schemas get the same treatment, not just top-level ones.
+func NewSchemaOrReference(info interface{}, context *compiler.Context) (*SchemaOrReference, error) {
+	m, ok := compiler.UnpackMap(info)
+	if !ok {
+		return nil, fmt.Errorf("openapi_v31: could not unpack schema")
+	}
+	if ref, ok := compiler.MapValueForKey(m, "$ref").(string); ok {
+		return &SchemaOrReference{Reference: &Reference{XRef: ref}}, nil
+	}
+
+	schema := &Schema{}
+	if v, ok := compiler.MapValueForKey(m, "format").(string); ok {
+		schema.Format = v
+	}
+	if v, ok := compiler.MapValueForKey(m, "description").(string); ok {
+		schema.Description = v
+	}
+	if v := compiler.MapValueForKey(m, "default"); v != nil {
+		schema.Default = v
+	}
+	if enumSlice, ok := compiler.MapValueForKey(m, "enum").([]interface{}); ok {
+		schema.Enum = enumSlice
+	}
+
+	var types []string
+	switch v := compiler.MapValueForKey(m, "type").(type) {
+	case string:
+		types = []string{v}
+	case []interface{}:
+		for _, t := range v {
+			if s, ok := t.(string); ok {
+				types = append(types, s)
+			}
+		}
+	}
+	if nullable, ok := compiler.MapValueForKey(m, "nullable").(bool); ok && nullable {
+		types = append(types, "null")
+	}
+	if types != nil {
+		schema.Type = &SchemaType{TypeArray: types}
+	}
+
+	if propertiesMap, ok := compiler.UnpackMap(compiler.MapValueForKey(m, "properties")); ok {
+		schema.Properties = map[string]*SchemaOrReference{}
+		for _, item := range propertiesMap {
+			name, ok := item.Key.(string)
+			if !ok {
+				continue
+			}
+			property, err := NewSchemaOrReference(item.Value, context)
+			if err != nil {
+				return nil, err
+			}
+			schema.Properties[name] = property
+		}
+	}
+	if itemsInfo := compiler.MapValueForKey(m, "items"); itemsInfo != nil {
+		items, err := NewSchemaOrReference(itemsInfo, context)
+		if err != nil {
+			return nil, err
+		}
+		schema.Items = items
+	}
+
+	return &SchemaOrReference{Schema: schema}, nil
+}
+
+// componentSchemaRef matches a "#/components/schemas/Name" reference, the
+// only kind of internal $ref this compiler currently resolves.
+var componentSchemaRef = regexp.MustCompile(`^#/components/schemas/(.+)$`)
+
+// ResolveReferences resolves internal "#/components/schemas/..." references
+// by populating each SchemaOrReference's Schema field in place, mirroring
+// OpenAPIv3.Document.ResolveReferences. References to other documents or to
+// non-schema components are left unresolved and reported as errors, as are
+// references that don't resolve to a known schema.
+func (d *Document) ResolveReferences(sourceName string) ([]error, error) {
+	if d.Components == nil {
+		return nil, nil
+	}
+	var errs []error
+	resolving := map[string]bool{}
+	var resolve func(ref *SchemaOrReference) *SchemaOrReference
+	var walk func(schema *Schema)
+	resolve = func(ref *SchemaOrReference) *SchemaOrReference {
+		if ref == nil {
+			return ref
+		}
+		if ref.Reference == nil {
+			walk(ref.Schema)
+			return ref
+		}
+		match := componentSchemaRef.FindStringSubmatch(ref.Reference.XRef)
+		if match == nil {
+			errs = append(errs, fmt.Errorf("%s: unsupported reference %s", sourceName, ref.Reference.XRef))
+			return ref
+		}
+		name := match[1]
+		if resolving[name] {
+			errs = append(errs, fmt.Errorf("%s: cyclic reference to %s", sourceName, ref.Reference.XRef))
+			return ref
+		}
+		target, ok := d.Components.Schemas[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unresolved reference %s", sourceName, ref.Reference.XRef))
+			return ref
+		}
+		resolving[name] = true
+		target = resolve(target)
+		resolving[name] = false
+		return target
+	}
+	// walk descends into a resolved schema's properties and items, the same
+	// places NewSchemaOrReference recurses into while compiling, so a $ref
+	// nested below the top level of components.schemas (not just a $ref that
+	// *is* a components.schemas entry) gets resolved too.
+	walk = func(schema *Schema) {
+		if schema == nil {
+			return
+		}
+		for name, property := range schema.Properties {
+			schema.Properties[name] = resolve(property)
+		}
+		if schema.Items != nil {
+			schema.Items = resolve(schema.Items)
+		}
+	}
+	for name, schema := range d.Components.Schemas {
+		d.Components.Schemas[name] = resolve(schema)
+	}
+	return errs, nil
+}
+
+// The following methods satisfy the legacy golang/protobuf proto.Message
+// interface, as OpenAPIv2.Document and OpenAPIv3.Document do via their
+// generated code.
+func (d *Document) Reset()         { *d = Document{} }
+func (d *Document) String() string { return proto.CompactTextString(d) }
+func (*Document) ProtoMessage()    {}
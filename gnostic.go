@@ -33,6 +33,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -42,21 +43,107 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/googleapis/gnostic/OpenAPIv2"
 	"github.com/googleapis/gnostic/OpenAPIv3"
+	"github.com/googleapis/gnostic/OpenAPIv31"
 	"github.com/googleapis/gnostic/compiler"
 	plugins "github.com/googleapis/gnostic/plugins"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/jaeger"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 )
 
+// tracerName identifies the tracer used for all gnostic spans.
+const tracerName = "github.com/googleapis/gnostic"
+
+// shutdownTimeout bounds how long gnostic will wait for a trace exporter
+// to flush on exit, so short CLI runs still export their spans.
+const shutdownTimeout = 5 * time.Second
+
+// stderrTailBytes bounds how much of a failed plugin's stderr is retained
+// for its structured error report.
+const stderrTailBytes = 4096
+
+// stderrReporter serializes stderr writes from concurrently-running
+// plugins so interleaved output stays readable.
+type stderrReporter struct {
+	mu sync.Mutex
+}
+
+// writer returns an io.Writer that copies everything written to it to
+// stderr (under the reporter's lock) while also retaining a bounded tail
+// in tail, for use in error reports.
+func (r *stderrReporter) writer(tail *bytes.Buffer) io.Writer {
+	return &taggedStderrWriter{reporter: r, tail: tail}
+}
+
+type taggedStderrWriter struct {
+	reporter *stderrReporter
+	tail     *bytes.Buffer
+}
+
+func (w *taggedStderrWriter) Write(p []byte) (int, error) {
+	w.reporter.mu.Lock()
+	defer w.reporter.mu.Unlock()
+	os.Stderr.Write(p)
+	w.tail.Write(p)
+	if overflow := w.tail.Len() - stderrTailBytes; overflow > 0 {
+		remaining := append([]byte(nil), w.tail.Bytes()[overflow:]...)
+		w.tail.Reset()
+		w.tail.Write(remaining)
+	}
+	return len(p), nil
+}
+
+// pluginError reports a failed plugin invocation with enough detail for a
+// structured error report: which plugin, how it was invoked, the tail of
+// its stderr, its exit code, and how long it ran.
+type pluginError struct {
+	Plugin     string `json:"plugin"`
+	Invocation string `json:"invocation"`
+	StderrTail string `json:"stderr_tail"`
+	ExitCode   int    `json:"exit_code"`
+	DurationMs int64  `json:"duration_ms"`
+	Message    string `json:"message"`
+	Err        error  `json:"-"`
+}
+
+func (e *pluginError) Error() string {
+	return fmt.Sprintf("plugin %s failed: %v", e.Plugin, e.Err)
+}
+
 const ( // OpenAPI Version
 	OpenAPIvUnknown = 0
 	OpenAPIv2       = 2
 	OpenAPIv3       = 3
+	OpenAPIv31      = 4
 )
 
+// openAPIv3xVersion matches "openapi" version strings of the 3.x line,
+// capturing the minor version so 3.0.x and 3.1.x can be routed to their
+// respective compilers.
+var openAPIv3xVersion = regexp.MustCompile(`^3\.(\d+)\.\d+$`)
+
 // Determine the version of an OpenAPI description read from JSON or YAML.
 func getOpenAPIVersionFromInfo(info interface{}) int {
 	m, ok := compiler.UnpackMap(info)
@@ -68,10 +155,26 @@ func getOpenAPIVersionFromInfo(info interface{}) int {
 		return OpenAPIv2
 	}
 	openapi, ok := compiler.MapValueForKey(m, "openapi").(string)
-	if ok && openapi == "3.0" {
+	if !ok {
+		return OpenAPIvUnknown
+	}
+	// Older gnostic releases only recognized the exact string "3.0"; accept
+	// that as well as any fully-qualified 3.0.x/3.1.x patch version.
+	if openapi == "3.0" {
 		return OpenAPIv3
 	}
-	return OpenAPIvUnknown
+	match := openAPIv3xVersion.FindStringSubmatch(openapi)
+	if match == nil {
+		return OpenAPIvUnknown
+	}
+	switch match[1] {
+	case "0":
+		return OpenAPIv3
+	case "1":
+		return OpenAPIv31
+	default:
+		return OpenAPIvUnknown
+	}
 }
 
 const (
@@ -79,14 +182,212 @@ const (
 	extensionPrefix = "gnostic-x-"
 )
 
+// Pull policies for the container plugin runner, selected with
+// --plugin-pull-policy.
+const (
+	PullPolicyAlways       = "always"
+	PullPolicyIfNotPresent = "ifnotpresent"
+	PullPolicyNever        = "never"
+)
+
+// containerInvocationRegex recognizes "docker://" and "oci://" plugin
+// invocations, where the image reference (which may itself contain colons
+// for tags and "@sha256:..." digests) is followed by a final ":" and the
+// output path.
+var containerInvocationRegex = regexp.MustCompile(`^(docker|oci):\/\/[\w\-\.\/@:]+:[^,:=]+$`)
+
+// PluginRunner abstracts how a plugin's serialized request is delivered and
+// its response collected. PluginCall.perform picks the runner from the
+// invocation; past that point, neither it nor performActions needs to know
+// whether a plugin is a local executable or a container.
+type PluginRunner interface {
+	// Run sends requestBytes to the plugin on stdin and returns the bytes
+	// it wrote to stdout, along with its exit code. Anything the plugin
+	// writes to stderr is copied to stderr as it arrives.
+	Run(ctx context.Context, requestBytes []byte, stderr io.Writer) (output []byte, exitCode int, err error)
+}
+
+// execPluginRunner runs a plugin as a local executable found on PATH, the
+// original and still-default execution backend.
+type execPluginRunner struct {
+	executableName string
+}
+
+func (r *execPluginRunner) Run(ctx context.Context, requestBytes []byte, stderr io.Writer) ([]byte, int, error) {
+	cmd := exec.CommandContext(ctx, r.executableName)
+	cmd.Stdin = bytes.NewReader(requestBytes)
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	return output, processExitCode(cmd, err), err
+}
+
+// containerPluginRunner runs a plugin packaged as an OCI image, pulling it
+// through the local Docker/containerd client and piping the serialized
+// plugins.Request/plugins.Response over the container's stdin/stdout.
+type containerPluginRunner struct {
+	image      string
+	pullPolicy string
+}
+
+// newContainerPluginRunner builds a containerPluginRunner from a plugin
+// invocation's image reference, stripping the "docker://"/"oci://" scheme
+// prefix (if any) so that r.image is always a reference the Docker Engine
+// API will accept directly.
+func newContainerPluginRunner(rawImage, pullPolicy string) *containerPluginRunner {
+	name, digest := splitImageDigest(rawImage)
+	ref := name
+	if digest != "" {
+		ref = name + "@" + digest
+	}
+	return &containerPluginRunner{image: ref, pullPolicy: pullPolicy}
+}
+
+func (r *containerPluginRunner) Run(ctx context.Context, requestBytes []byte, stderr io.Writer) ([]byte, int, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, -1, err
+	}
+	defer cli.Close()
+
+	if err := r.ensureImage(ctx, cli); err != nil {
+		return nil, -1, err
+	}
+
+	created, err := cli.ContainerCreate(ctx, &container.Config{
+		Image:        r.image,
+		OpenStdin:    true,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	}, nil, nil, nil, "")
+	if err != nil {
+		return nil, -1, err
+	}
+	defer cli.ContainerRemove(ctx, created.ID, container.RemoveOptions{Force: true})
+
+	attach, err := cli.ContainerAttach(ctx, created.ID, container.AttachOptions{
+		Stream: true, Stdin: true, Stdout: true, Stderr: true,
+	})
+	if err != nil {
+		return nil, -1, err
+	}
+	defer attach.Close()
+
+	if err := cli.ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+		return nil, -1, err
+	}
+	if _, err := attach.Conn.Write(requestBytes); err != nil {
+		return nil, -1, err
+	}
+	attach.CloseWrite()
+
+	var stdout bytes.Buffer
+	stdcopy.StdCopy(&stdout, stderr, attach.Reader)
+
+	statusCh, errCh := cli.ContainerWait(ctx, created.ID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return nil, -1, err
+		}
+		return stdout.Bytes(), 0, nil
+	case status := <-statusCh:
+		return stdout.Bytes(), int(status.StatusCode), nil
+	}
+}
+
+// ensureImage pulls r.image according to r.pullPolicy, and, when the image
+// reference is digest-pinned (has an "@sha256:..." suffix), verifies that
+// the pulled image's digest matches before returning.
+func (r *containerPluginRunner) ensureImage(ctx context.Context, cli *client.Client) error {
+	_, wantDigest := splitImageDigest(r.image)
+
+	_, _, inspectErr := cli.ImageInspectWithRaw(ctx, r.image)
+	present := inspectErr == nil
+
+	switch r.pullPolicy {
+	case PullPolicyNever:
+		if !present {
+			return fmt.Errorf("image %s is not present locally and --plugin-pull-policy=never", r.image)
+		}
+	case PullPolicyIfNotPresent:
+		if !present {
+			if err := pullImage(ctx, cli, r.image); err != nil {
+				return err
+			}
+		}
+	case PullPolicyAlways, "":
+		if err := pullImage(ctx, cli, r.image); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown plugin pull policy: %s", r.pullPolicy)
+	}
+
+	if wantDigest != "" {
+		inspect, _, err := cli.ImageInspectWithRaw(ctx, r.image)
+		if err != nil {
+			return err
+		}
+		for _, repoDigest := range inspect.RepoDigests {
+			if strings.HasSuffix(repoDigest, wantDigest) {
+				return nil
+			}
+		}
+		return fmt.Errorf("image %s does not match pinned digest %s", r.image, wantDigest)
+	}
+	return nil
+}
+
+// pullImage pulls an image and blocks until the pull completes.
+func pullImage(ctx context.Context, cli *client.Client, ref string) error {
+	reader, err := cli.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(io.Discard, reader)
+	return err
+}
+
+// splitImageDigest splits a docker://-style image reference into its image
+// name and, if present, its "@sha256:..." digest.
+func splitImageDigest(image string) (name string, digest string) {
+	image = strings.TrimPrefix(strings.TrimPrefix(image, "docker://"), "oci://")
+	if idx := strings.Index(image, "@"); idx != -1 {
+		return image[:idx], image[idx+1:]
+	}
+	return image, ""
+}
+
 type PluginCall struct {
 	Name       string
 	Invocation string
 }
 
 // Invokes a plugin.
-func (pluginCall *PluginCall) perform(document proto.Message, openAPIVersion int, sourceName string) error {
+func (pluginCall *PluginCall) perform(ctx context.Context, document proto.Message, openAPIVersion int, sourceName string, pullPolicy string, reporter *stderrReporter) error {
 	if pluginCall.Name != "" {
+		ctx, span := otel.Tracer(tracerName).Start(ctx, "PluginCall.perform",
+			trace.WithAttributes(attribute.String("gnostic.plugin.name", pluginCall.Name)))
+		defer span.End()
+
+		start := time.Now()
+		var stderrTail bytes.Buffer
+		stderr := reporter.writer(&stderrTail)
+		failf := func(exitCode int, err error) error {
+			span.RecordError(err)
+			return &pluginError{
+				Plugin:     pluginCall.Name,
+				Invocation: pluginCall.Invocation,
+				StderrTail: stderrTail.String(),
+				ExitCode:   exitCode,
+				DurationMs: time.Since(start).Milliseconds(),
+				Message:    err.Error(),
+				Err:        err,
+			}
+		}
+
 		request := &plugins.Request{}
 
 		// Infer the name of the executable by adding the prefix.
@@ -96,35 +397,51 @@ func (pluginCall *PluginCall) perform(document proto.Message, openAPIVersion int
 		invocation := pluginCall.Invocation
 
 		//
-		// Plugin invocations must consist of
-		// zero or more comma-separated key=value pairs followed by a path.
-		// If pairs are present, a colon separates them from the path.
-		// Keys and values must be alphanumeric strings and may contain
-		// dashes, underscores, periods, or forward slashes.
-		// A path can contain any characters other than the separators ',', ':', and '='.
+		// Plugin invocations must consist of either
+		//   - zero or more comma-separated key=value pairs followed by a path,
+		//     with a colon separating the pairs from the path when present, or
+		//   - a "docker://" or "oci://" image reference followed by a colon
+		//     and a path.
+		// Keys must be alphanumeric strings and may contain dashes,
+		// underscores, periods, or forward slashes. Values may additionally
+		// contain ':' and '@', since an "image=" value can be a tagged
+		// and/or digest-pinned image reference. A path can contain any
+		// characters other than the separators ',', ':', and '='.
 		//
-		invocation_regex := regexp.MustCompile(`^([\w-_\/\.]+=[\w-_\/\.]+(,[\w-_\/\.]+=[\w-_\/\.]+)*:)?[^,:=]+$`)
-		if !invocation_regex.Match([]byte(pluginCall.Invocation)) {
-			return errors.New(fmt.Sprintf("Invalid invocation of %s: %s", executableName, invocation))
+		invocation_regex := regexp.MustCompile(`^([\w-_\/\.]+=[\w-_\/\.@:]+(,[\w-_\/\.]+=[\w-_\/\.@:]+)*:)?[^,:=]+$`)
+		isContainerInvocation := containerInvocationRegex.MatchString(invocation)
+		if !isContainerInvocation && !invocation_regex.Match([]byte(pluginCall.Invocation)) {
+			return failf(-1, errors.New(fmt.Sprintf("Invalid invocation of %s: %s", executableName, invocation)))
 		}
 
-		invocationParts := strings.Split(pluginCall.Invocation, ":")
+		var runner PluginRunner
 		var outputLocation string
-		switch len(invocationParts) {
-		case 1:
-			outputLocation = invocationParts[0]
-		case 2:
-			parameters := strings.Split(invocationParts[0], ",")
+		if isContainerInvocation {
+			idx := strings.LastIndex(invocation, ":")
+			runner = newContainerPluginRunner(invocation[:idx], pullPolicy)
+			outputLocation = invocation[idx+1:]
+		} else if idx := strings.LastIndex(invocation, ":"); idx == -1 {
+			// No parameters, just a path.
+			outputLocation = invocation
+			runner = &execPluginRunner{executableName: executableName}
+		} else {
+			// Parameters may themselves contain colons (e.g. an "image=" value
+			// with a tag or digest), so the path is everything after the
+			// *last* colon rather than the result of splitting on every colon.
+			outputLocation = invocation[idx+1:]
+			parameters := strings.Split(invocation[:idx], ",")
 			for _, keyvalue := range parameters {
-				pair := strings.Split(keyvalue, "=")
+				pair := strings.SplitN(keyvalue, "=", 2)
 				if len(pair) == 2 {
 					request.Parameters = append(request.Parameters, &plugins.Parameter{Name: pair[0], Value: pair[1]})
+					if pair[0] == "image" {
+						runner = newContainerPluginRunner(pair[1], pullPolicy)
+					}
 				}
 			}
-			outputLocation = invocationParts[1]
-		default:
-			// badly-formed request
-			outputLocation = invocationParts[len(invocationParts)-1]
+			if runner == nil {
+				runner = &execPluginRunner{executableName: executableName}
+			}
 		}
 
 		version := &plugins.Version{}
@@ -135,6 +452,33 @@ func (pluginCall *PluginCall) perform(document proto.Message, openAPIVersion int
 
 		request.OutputPath = outputLocation
 
+		// userParameterCount is the number of parameters the user actually
+		// wrote in the invocation string, recorded before the otel-* values
+		// below are appended so the parameter_count span attribute reflects
+		// what the user passed rather than gnostic's internal trace plumbing.
+		userParameterCount := len(request.Parameters)
+
+		// Propagate the current span context so the plugin can continue the
+		// trace.
+		//
+		// This is a deliberate, interim deviation from a dedicated
+		// plugins.Request.TraceContext field: that means changing the
+		// generated plugins proto, which isn't done here, so the W3C
+		// traceparent/tracestate values ride along as reserved
+		// "otel-traceparent"/"otel-tracestate" Parameters instead. Plugins
+		// that don't know to skip them will see them as ordinary
+		// parameters (gnostic's own parameter_count attribute above already
+		// excludes them). Once plugins.proto gains a TraceContext field,
+		// this should move there and these reserved names retired.
+		carrier := propagation.MapCarrier{}
+		otel.GetTextMapPropagator().Inject(ctx, carrier)
+		if traceparent := carrier["traceparent"]; traceparent != "" {
+			request.Parameters = append(request.Parameters, &plugins.Parameter{Name: "otel-traceparent", Value: traceparent})
+		}
+		if tracestate := carrier["tracestate"]; tracestate != "" {
+			request.Parameters = append(request.Parameters, &plugins.Parameter{Name: "otel-tracestate", Value: tracestate})
+		}
+
 		wrapper := &plugins.Wrapper{}
 		wrapper.Name = sourceName
 		switch openAPIVersion {
@@ -142,29 +486,51 @@ func (pluginCall *PluginCall) perform(document proto.Message, openAPIVersion int
 			wrapper.Version = "v2"
 		case OpenAPIv3:
 			wrapper.Version = "v3"
+		case OpenAPIv31:
+			// Set for forward compatibility (it's what a downstream
+			// generator would branch on), but currently unreachable: the
+			// guard below fails before a wrapper carrying "v3.1" is ever
+			// sent to a plugin. See that guard for why.
+			wrapper.Version = "v3.1"
 		default:
 			wrapper.Version = "unknown"
 		}
+		if openAPIVersion == OpenAPIv31 {
+			// Explicit descope: plugin support for OpenAPI 3.1 is not part
+			// of this change. openapi_v31.Document has no generated proto
+			// behind it, so proto.Marshal can't encode it -- it would
+			// silently reflect out an empty message instead of failing,
+			// and every plugin would see a blank document with no way to
+			// tell the difference from an empty spec. Fail loudly instead
+			// of shipping that, until openapi_v31 has a real wire format to
+			// hand plugins.
+			return failf(-1, errors.New("gnostic: plugin invocation for OpenAPI 3.1 documents is not yet supported"))
+		}
 		protoBytes, _ := proto.Marshal(document)
 		wrapper.Value = protoBytes
 		request.Wrapper = wrapper
 		requestBytes, _ := proto.Marshal(request)
 
-		cmd := exec.Command(executableName)
-		cmd.Stdin = bytes.NewReader(requestBytes)
-		cmd.Stderr = os.Stderr
-		output, err := cmd.Output()
+		span.SetAttributes(
+			attribute.Int("gnostic.plugin.parameter_count", userParameterCount),
+			attribute.String("gnostic.plugin.output_location", outputLocation),
+			attribute.Int("gnostic.plugin.request_bytes", len(requestBytes)),
+		)
+
+		output, exitCode, err := runner.Run(ctx, requestBytes, stderr)
+		span.SetAttributes(attribute.Int("gnostic.plugin.exit_code", exitCode))
 		if err != nil {
-			return err
+			return failf(exitCode, err)
 		}
+		span.SetAttributes(attribute.Int("gnostic.plugin.response_bytes", len(output)))
 		response := &plugins.Response{}
 		err = proto.Unmarshal(output, response)
 		if err != nil {
-			return err
+			return failf(exitCode, err)
 		}
 
 		if response.Errors != nil {
-			return errors.New(fmt.Sprintf("Plugin error: %+v", response.Errors))
+			return failf(exitCode, errors.New(fmt.Sprintf("Plugin error: %+v", response.Errors)))
 		}
 
 		// write files to the specified directory
@@ -178,24 +544,69 @@ func (pluginCall *PluginCall) perform(document proto.Message, openAPIVersion int
 				writer.Write(file.Data)
 			}
 		} else if isFile(outputLocation) {
-			return errors.New(fmt.Sprintf("Error, unable to overwrite %s\n", outputLocation))
+			return failf(exitCode, errors.New(fmt.Sprintf("Error, unable to overwrite %s\n", outputLocation)))
 		} else {
+			// Stage files in a per-plugin temporary directory and only move
+			// them into outputLocation once every file has been written
+			// successfully, so overlapping plugin outputs never interleave
+			// a partial write. The staging directory is created alongside
+			// outputLocation (rather than under the system temp dir) so the
+			// commit below can rename rather than copy: os.MkdirTemp("",...)
+			// is commonly a tmpfs, and renaming across that boundary onto
+			// outputLocation's filesystem fails with EXDEV.
 			if !isDirectory(outputLocation) {
-				os.Mkdir(outputLocation, 0755)
+				os.MkdirAll(outputLocation, 0755)
 			}
+			stagingDir, err := os.MkdirTemp(outputLocation, ".gnostic-"+pluginCall.Name+"-")
+			if err != nil {
+				return failf(exitCode, err)
+			}
+			defer os.RemoveAll(stagingDir)
 			for _, file := range response.Files {
-				p := outputLocation + "/" + file.Name
+				p := stagingDir + "/" + file.Name
 				dir := path.Dir(p)
 				os.MkdirAll(dir, 0755)
-				f, _ := os.Create(p)
-				defer f.Close()
-				f.Write(file.Data)
+				f, err := os.Create(p)
+				if err != nil {
+					return failf(exitCode, err)
+				}
+				_, err = f.Write(file.Data)
+				if closeErr := f.Close(); err == nil {
+					err = closeErr
+				}
+				if err != nil {
+					return failf(exitCode, fmt.Errorf("writing %s: %w", p, err))
+				}
+			}
+			// Commit: move each staged file into its final location. A
+			// failed rename must not be swallowed: the plugin's output would
+			// otherwise silently vanish (via the deferred RemoveAll above)
+			// while performActions reports success.
+			for _, file := range response.Files {
+				src := stagingDir + "/" + file.Name
+				dst := outputLocation + "/" + file.Name
+				os.MkdirAll(path.Dir(dst), 0755)
+				if err := os.Rename(src, dst); err != nil {
+					return failf(exitCode, fmt.Errorf("writing %s: %w", dst, err))
+				}
 			}
 		}
 	}
 	return nil
 }
 
+// processExitCode returns the exit code of a completed process invocation,
+// or -1 if the process could not be started at all.
+func processExitCode(cmd *exec.Cmd, err error) int {
+	if cmd.ProcessState != nil {
+		return cmd.ProcessState.ExitCode()
+	}
+	if err != nil {
+		return -1
+	}
+	return 0
+}
+
 func isFile(path string) bool {
 	fileInfo, err := os.Stat(path)
 	if err != nil {
@@ -259,6 +670,11 @@ type Gnostic struct {
 	pluginCalls       []*PluginCall
 	extensionHandlers []compiler.ExtensionHandler
 	openAPIVersion    int
+	traceExporter     string
+	traceEndpoint     string
+	tracerProvider    *sdktrace.TracerProvider
+	pluginPullPolicy  string
+	jobs              int
 }
 
 // Initialize a structure to store global application state.
@@ -274,11 +690,26 @@ Options:
   --text-out=PATH     Write a text proto to the specified location.
   --errors-out=PATH   Write compilation errors to the specified location.
   --PLUGIN-out=PATH   Run the plugin named gnostic_PLUGIN and write results
-                      to the specified location.
+                      to the specified location. PATH may instead be a
+                      "docker://" or "oci://" image reference followed by
+                      ":PATH" to run the plugin in a container, e.g.
+                      --PLUGIN-out=docker://ghcr.io/acme/gnostic-foo:v1@sha256:...:out/
   --x-EXTENSION       Use the extension named gnostic-x-EXTENSION
                       to process OpenAPI specification extensions.
   --resolve-refs      Explicitly resolve $ref references.
                       This could have problems with recursive definitions.
+  --trace-exporter=X  Export OpenTelemetry traces via "otlp", "jaeger",
+                      "stdout", or "none" (default "none", or "otlp" when
+                      the OTEL_EXPORTER_OTLP_ENDPOINT environment variable
+                      is set). OTEL_SERVICE_NAME sets the reported service
+                      name.
+  --trace-endpoint=X  The collector endpoint used by the otlp and jaeger
+                      trace exporters.
+  --plugin-pull-policy=X
+                      When running containerized plugins, pull images
+                      "always", "ifnotpresent", or "never" (default "ifnotpresent").
+  --jobs=N            Run up to N plugins concurrently (default: number of
+                      CPUs).
 `
 	// default values for all options
 	g.sourceName = ""
@@ -287,6 +718,16 @@ Options:
 	g.textProtoPath = ""
 	g.errorPath = ""
 	g.resolveReferences = false
+	g.traceEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if g.traceEndpoint != "" {
+		// Honor OTEL_EXPORTER_OTLP_ENDPOINT on its own, without also
+		// requiring --trace-exporter=otlp.
+		g.traceExporter = "otlp"
+	} else {
+		g.traceExporter = "none"
+	}
+	g.pluginPullPolicy = PullPolicyIfNotPresent
+	g.jobs = runtime.NumCPU()
 
 	// internal structures
 	g.pluginCalls = make([]*PluginCall, 0)
@@ -329,6 +770,19 @@ func (g *Gnostic) readOptions() {
 			g.extensionHandlers = append(g.extensionHandlers, extensionHandler)
 		} else if arg == "--resolve-refs" {
 			g.resolveReferences = true
+		} else if strings.HasPrefix(arg, "--trace-exporter=") {
+			g.traceExporter = strings.TrimPrefix(arg, "--trace-exporter=")
+		} else if strings.HasPrefix(arg, "--trace-endpoint=") {
+			g.traceEndpoint = strings.TrimPrefix(arg, "--trace-endpoint=")
+		} else if strings.HasPrefix(arg, "--plugin-pull-policy=") {
+			g.pluginPullPolicy = strings.TrimPrefix(arg, "--plugin-pull-policy=")
+		} else if strings.HasPrefix(arg, "--jobs=") {
+			jobs, err := strconv.Atoi(strings.TrimPrefix(arg, "--jobs="))
+			if err != nil || jobs < 1 {
+				fmt.Fprintf(os.Stderr, "Invalid --jobs value: %s.\n%s\n", arg, g.usage)
+				os.Exit(-1)
+			}
+			g.jobs = jobs
 		} else if arg[0] == '-' {
 			fmt.Fprintf(os.Stderr, "Unknown option: %s.\n%s\n", arg, g.usage)
 			os.Exit(-1)
@@ -358,32 +812,113 @@ func (g *Gnostic) validateOptions() {
 	}
 }
 
+// initTracing configures the global OpenTelemetry tracer provider according
+// to the --trace-exporter/--trace-endpoint flags and the OTEL_* environment
+// variables. It is a no-op (using a no-op tracer) when tracing is disabled.
+func (g *Gnostic) initTracing() {
+	if g.traceExporter == "" {
+		g.traceExporter = "none"
+	}
+	if g.traceExporter == "none" {
+		return
+	}
+
+	ctx := context.Background()
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch g.traceExporter {
+	case "otlp":
+		opts := []otlptracegrpc.Option{}
+		if g.traceEndpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(g.traceEndpoint))
+		}
+		exporter, err = otlptracegrpc.New(ctx, opts...)
+	case "jaeger":
+		endpoint := g.traceEndpoint
+		if endpoint == "" {
+			endpoint = "http://localhost:14268/api/traces"
+		}
+		exporter, err = jaeger.New(jaeger.WithCollectorEndpoint(jaeger.WithEndpoint(endpoint)))
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown trace exporter: %s.\n%s\n", g.traceExporter, g.usage)
+		os.Exit(-1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to configure %s trace exporter: %v\n", g.traceExporter, err)
+		return
+	}
+
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = "gnostic"
+	}
+	res, _ := resource.Merge(resource.Default(),
+		resource.NewSchemaless(semconv.ServiceNameKey.String(serviceName)))
+
+	g.tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(g.tracerProvider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+// shutdownTracing flushes and stops the tracer provider, bounded by
+// shutdownTimeout so that short CLI runs still export their spans.
+func (g *Gnostic) shutdownTracing() {
+	if g.tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := g.tracerProvider.Shutdown(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "Error shutting down trace provider: %v\n", err)
+	}
+}
+
 // Generate an error message to be written to stderr or a file.
 func (g *Gnostic) errorBytes(err error) []byte {
 	return []byte("Errors reading " + g.sourceName + "\n" + err.Error())
 }
 
 // Read an OpenAPI description from YAML or JSON.
-func (g *Gnostic) readOpenAPIText(bytes []byte) (message proto.Message, err error) {
+func (g *Gnostic) readOpenAPIText(ctx context.Context, bytes []byte) (message proto.Message, err error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "readOpenAPIText")
+	defer span.End()
+
 	info, err := compiler.ReadInfoFromBytes(g.sourceName, bytes)
 	if err != nil {
+		span.RecordError(err)
 		return nil, err
 	}
 	// Determine the OpenAPI version.
 	g.openAPIVersion = getOpenAPIVersionFromInfo(info)
 	if g.openAPIVersion == OpenAPIvUnknown {
-		return nil, errors.New("Unable to identify OpenAPI version.")
+		err = errors.New("Unable to identify OpenAPI version.")
+		span.RecordError(err)
+		return nil, err
 	}
 	// Compile to the proto model.
 	if g.openAPIVersion == OpenAPIv2 {
 		document, err := openapi_v2.NewDocument(info, compiler.NewContextWithExtensions("$root", nil, &g.extensionHandlers))
 		if err != nil {
+			span.RecordError(err)
 			return nil, err
 		}
 		message = document
 	} else if g.openAPIVersion == OpenAPIv3 {
 		document, err := openapi_v3.NewDocument(info, compiler.NewContextWithExtensions("$root", nil, &g.extensionHandlers))
 		if err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+		message = document
+	} else if g.openAPIVersion == OpenAPIv31 {
+		document, err := openapi_v31.NewDocument(info, compiler.NewContextWithExtensions("$root", nil, &g.extensionHandlers))
+		if err != nil {
+			span.RecordError(err)
 			return nil, err
 		}
 		message = document
@@ -392,7 +927,16 @@ func (g *Gnostic) readOpenAPIText(bytes []byte) (message proto.Message, err erro
 }
 
 // Read an OpenAPI binary file.
-func (g *Gnostic) readOpenAPIBinary(data []byte) (message proto.Message, err error) {
+func (g *Gnostic) readOpenAPIBinary(ctx context.Context, data []byte) (message proto.Message, err error) {
+	_, span := otel.Tracer(tracerName).Start(ctx, "readOpenAPIBinary")
+	defer span.End()
+
+	// There is no generated openapi_v31 proto with its own field tags, so
+	// unmarshaling into one can't distinguish a 3.1 document from any other
+	// wire-format bytes: proto.Unmarshal silently accepts them, parks
+	// everything in unknown fields, and returns an empty document with a
+	// nil error. Binary .pb input is only ever an openapi_v2/v3 Document in
+	// practice, so just try those.
 	// try to read an OpenAPI v3 document
 	document_v3 := &openapi_v3.Document{}
 	err = proto.Unmarshal(data, document_v3)
@@ -405,100 +949,201 @@ func (g *Gnostic) readOpenAPIBinary(data []byte) (message proto.Message, err err
 	if err == nil {
 		return document_v2, nil
 	}
+	span.RecordError(err)
 	return nil, err
 }
 
 // Perform all actions specified in the command-line options.
-func (g *Gnostic) performActions(message proto.Message) (err error) {
+func (g *Gnostic) performActions(ctx context.Context, message proto.Message) (err error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "performActions")
+	defer span.End()
+
 	// Optionally resolve internal references.
 	if g.resolveReferences {
+		_, resolveSpan := otel.Tracer(tracerName).Start(ctx, "ResolveReferences")
 		if g.openAPIVersion == OpenAPIv2 {
 			document := message.(*openapi_v2.Document)
 			_, err = document.ResolveReferences(g.sourceName)
 		} else if g.openAPIVersion == OpenAPIv3 {
 			document := message.(*openapi_v3.Document)
 			_, err = document.ResolveReferences(g.sourceName)
+		} else if g.openAPIVersion == OpenAPIv31 {
+			document := message.(*openapi_v31.Document)
+			_, err = document.ResolveReferences(g.sourceName)
 		}
 		if err != nil {
+			resolveSpan.RecordError(err)
+			resolveSpan.End()
 			return err
 		}
+		resolveSpan.End()
 	}
+	// actionFailed records that some action below failed, without
+	// returning early: sibling outputs and all plugins still run, the
+	// same way a plugin failure doesn't stop the other plugins. It is
+	// what performActions ultimately returns, so that os.Exit happens
+	// once, at the top of the call stack, after every deferred span.End
+	// and g.shutdownTracing have had a chance to run.
+	var actionFailed error
+
 	// Optionally write proto in binary format.
 	if g.binaryProtoPath != "" {
-		protoBytes, err := proto.Marshal(message)
+		_, writeSpan := otel.Tracer(tracerName).Start(ctx, "writeProtoBinary")
+		var protoBytes []byte
+		var err error
+		if g.openAPIVersion == OpenAPIv31 {
+			// See the matching guard in PluginCall.perform: openapi_v31.Document
+			// has no generated proto behind it, so proto.Marshal would
+			// silently produce an empty message rather than fail.
+			err = errors.New("gnostic: binary proto output is not yet supported for OpenAPI 3.1 documents")
+		} else {
+			protoBytes, err = proto.Marshal(message)
+		}
 		if err != nil {
+			writeSpan.RecordError(err)
 			writeFile(g.errorPath, g.errorBytes(err), g.sourceName, "errors")
-			defer os.Exit(-1)
+			actionFailed = err
 		} else {
+			writeSpan.SetAttributes(attribute.Int("gnostic.bytes_written", len(protoBytes)))
 			writeFile(g.binaryProtoPath, protoBytes, g.sourceName, "pb")
 		}
+		writeSpan.End()
 	}
 	// Optionally write proto in json format.
 	if g.jsonProtoPath != "" {
-		jsonBytes, err := json.Marshal(message)
+		_, writeSpan := otel.Tracer(tracerName).Start(ctx, "writeProtoJSON")
+		var jsonBytes []byte
+		var err error
+		if g.openAPIVersion == OpenAPIv31 {
+			// openapi_v31.Document compiles path items and webhooks as raw,
+			// uninterpreted yaml.MapSlice values (see PathItem in
+			// OpenAPIv31.go), which json.Marshal renders as its underlying
+			// []struct{Key,Value} shape rather than OpenAPI JSON. Reject
+			// this the same way binary proto output above and text proto
+			// output below are rejected, rather than silently writing
+			// malformed JSON.
+			err = errors.New("gnostic: json output is not yet supported for OpenAPI 3.1 documents")
+		} else {
+			jsonBytes, err = json.Marshal(message)
+		}
 		if err != nil {
+			writeSpan.RecordError(err)
 			writeFile(g.errorPath, g.errorBytes(err), g.sourceName, "errors")
-			defer os.Exit(-1)
+			actionFailed = err
 		} else {
+			writeSpan.SetAttributes(attribute.Int("gnostic.bytes_written", len(jsonBytes)))
 			writeFile(g.jsonProtoPath, jsonBytes, g.sourceName, "json")
 		}
+		writeSpan.End()
 	}
 	// Optionally write proto in text format.
 	if g.textProtoPath != "" {
-		bytes := []byte(proto.MarshalTextString(message))
-		writeFile(g.textProtoPath, bytes, g.sourceName, "text")
-	}
-	// Call all specified plugins.
-	for _, pluginCall := range g.pluginCalls {
-		err := pluginCall.perform(message, g.openAPIVersion, g.sourceName)
-		if err != nil {
+		_, writeSpan := otel.Tracer(tracerName).Start(ctx, "writeProtoText")
+		if g.openAPIVersion == OpenAPIv31 {
+			err := errors.New("gnostic: text proto output is not yet supported for OpenAPI 3.1 documents")
+			writeSpan.RecordError(err)
 			writeFile(g.errorPath, g.errorBytes(err), g.sourceName, "errors")
-			defer os.Exit(-1) // run all plugins, even when some have errors
+			actionFailed = err
+		} else {
+			bytes := []byte(proto.MarshalTextString(message))
+			writeSpan.SetAttributes(attribute.Int("gnostic.bytes_written", len(bytes)))
+			writeFile(g.textProtoPath, bytes, g.sourceName, "text")
 		}
+		writeSpan.End()
 	}
-	return nil
+	// Call all specified plugins, running up to g.jobs of them at once.
+	// Plugin failures don't stop the rest from running; they're collected
+	// into a structured error report below.
+	reporter := &stderrReporter{}
+	semaphore := make(chan struct{}, g.jobs)
+	var wg sync.WaitGroup
+	var errsMu sync.Mutex
+	var pluginErrors []*pluginError
+	for _, pluginCall := range g.pluginCalls {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(pluginCall *PluginCall) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			err := pluginCall.perform(ctx, message, g.openAPIVersion, g.sourceName, g.pluginPullPolicy, reporter)
+			if err != nil {
+				pe, ok := err.(*pluginError)
+				if !ok {
+					pe = &pluginError{Plugin: pluginCall.Name, Invocation: pluginCall.Invocation, Message: err.Error(), Err: err}
+				}
+				errsMu.Lock()
+				pluginErrors = append(pluginErrors, pe)
+				errsMu.Unlock()
+			}
+		}(pluginCall)
+	}
+	wg.Wait()
+
+	if len(pluginErrors) > 0 {
+		report, _ := json.MarshalIndent(pluginErrors, "", "  ")
+		writeFile(g.errorPath, report, g.sourceName, "errors")
+		actionFailed = fmt.Errorf("%d plugin(s) failed", len(pluginErrors)) // run all plugins, even when some have errors
+	}
+	return actionFailed
 }
 
-func (g *Gnostic) main() {
+// main runs gnostic and returns the process exit code. It never calls
+// os.Exit itself, so that package main's deferred span.End and
+// g.shutdownTracing always run before the process exits: os.Exit bypasses
+// defers, and a run that fails (or is slow enough to be worth tracing) is
+// exactly the case where dropping its spans would hurt most.
+func (g *Gnostic) main() int {
 	var err error
 	g.readOptions()
 	g.validateOptions()
+	g.initTracing()
+	defer g.shutdownTracing()
+
+	ctx, span := otel.Tracer(tracerName).Start(context.Background(), "Gnostic.main",
+		trace.WithAttributes(attribute.String("gnostic.source", g.sourceName)))
+	defer span.End()
 
 	// Read the OpenAPI source.
 	bytes, err := compiler.ReadBytesForFile(g.sourceName)
 	if err != nil {
+		span.RecordError(err)
 		writeFile(g.errorPath, g.errorBytes(err), g.sourceName, "errors")
-		os.Exit(-1)
+		return -1
 	}
 	extension := strings.ToLower(filepath.Ext(g.sourceName))
 	var message proto.Message
 	if extension == ".json" || extension == ".yaml" {
 		// Try to read the source as JSON/YAML.
-		message, err = g.readOpenAPIText(bytes)
+		message, err = g.readOpenAPIText(ctx, bytes)
 		if err != nil {
+			span.RecordError(err)
 			writeFile(g.errorPath, g.errorBytes(err), g.sourceName, "errors")
-			os.Exit(-1)
+			return -1
 		}
 	} else if extension == ".pb" {
 		// Try to read the source as a binary protocol buffer.
-		message, err = g.readOpenAPIBinary(bytes)
+		message, err = g.readOpenAPIBinary(ctx, bytes)
 		if err != nil {
+			span.RecordError(err)
 			writeFile(g.errorPath, g.errorBytes(err), g.sourceName, "errors")
-			os.Exit(-1)
+			return -1
 		}
 	} else {
 		err = errors.New("Unknown file extension. 'json', 'yaml', and 'pb' are accepted.")
+		span.RecordError(err)
 		writeFile(g.errorPath, g.errorBytes(err), g.sourceName, "errors")
-		os.Exit(-1)
+		return -1
 	}
-	err = g.performActions(message)
+	err = g.performActions(ctx, message)
 	if err != nil {
+		span.RecordError(err)
 		writeFile(g.errorPath, g.errorBytes(err), g.sourceName, "errors")
-		os.Exit(-1)
+		return -1
 	}
+	return 0
 }
 
 func main() {
 	g := newGnostic()
-	g.main()
+	os.Exit(g.main())
 }